@@ -0,0 +1,475 @@
+/*
+ * Copyright (c) 2020. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package daemon
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// CommitOpts carries the parameters needed to snapshot a running container's
+// writable layer into a new nydus image built on top of this daemon's
+// existing bootstrap chain.
+type CommitOpts struct {
+	// ContainerPID is the pid of a process running inside the target
+	// container, used to check that its namespaces can be joined and to
+	// resolve its overlay upper dir.
+	ContainerPID int
+	// TargetRef is the registry reference the resulting image is pushed to,
+	// e.g. "registry.example.com/repo:tag".
+	TargetRef string
+	// IncludePaths, if non-empty, restricts the diff to these upper dir
+	// relative paths. ExcludePaths is applied after IncludePaths.
+	IncludePaths []string
+	ExcludePaths []string
+	// Pause freezes the container's cgroup for the duration of the diff so
+	// that the upper dir is observed at a single consistent point in time.
+	Pause bool
+	// Timeout, if positive, bounds the nydus-image invocation and the
+	// registry push. The upper dir walk and tar packing are not interrupted
+	// when it expires; they read the upper dir through its host path from
+	// the snapshotter's own namespaces, not from inside the container.
+	Timeout time.Duration
+}
+
+// Commit snapshots the writable layer of a running container backed by this
+// daemon's nydus mount, builds a new bootstrap+blob layered on top of the
+// daemon's current bootstrap, and pushes the resulting image to opts.TargetRef.
+func (d *Daemon) Commit(ctx context.Context, opts CommitOpts) error {
+	if opts.ContainerPID <= 0 {
+		return errors.New("commit: container pid is required")
+	}
+	if opts.TargetRef == "" {
+		return errors.New("commit: target ref is required")
+	}
+
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
+	parentBootstrap, err := d.BootstrapFile()
+	if err != nil {
+		return errors.Wrap(err, "commit: resolve parent bootstrap")
+	}
+
+	upperDir, err := resolveOverlayUpperDir(opts.ContainerPID)
+	if err != nil {
+		return errors.Wrap(err, "commit: resolve overlay upper dir")
+	}
+
+	if err := d.ProbeContainerNamespaces(opts.ContainerPID, 10*time.Second); err != nil {
+		return errors.Wrap(err, "commit: container namespaces are not accessible")
+	}
+
+	var thaw func()
+	if opts.Pause {
+		thaw, err = freezeContainer(opts.ContainerPID)
+		if err != nil {
+			return errors.Wrap(err, "commit: pause container")
+		}
+	}
+
+	// The container is only paused for the duration of the diff itself, per
+	// CommitOpts.Pause: thaw must happen as soon as packChanges has read the
+	// upper dir, not linger through the (potentially slow, network-bound)
+	// nydus-image build and registry push below.
+	changes, err := diffUpperDir(upperDir, opts.IncludePaths, opts.ExcludePaths)
+	if err != nil {
+		if thaw != nil {
+			thaw()
+		}
+		return errors.Wrap(err, "commit: diff upper dir")
+	}
+
+	layerTar, err := os.CreateTemp("", "nydus-commit-layer-*.tar")
+	if err != nil {
+		if thaw != nil {
+			thaw()
+		}
+		return errors.Wrap(err, "commit: create layer tar")
+	}
+	defer os.Remove(layerTar.Name())
+	defer layerTar.Close()
+
+	err = packChanges(upperDir, changes, layerTar)
+	if thaw != nil {
+		thaw()
+	}
+	if err != nil {
+		return errors.Wrap(err, "commit: pack layer tar")
+	}
+
+	bootstrap, blob, workDir, err := buildNydusLayer(ctx, parentBootstrap, layerTar.Name())
+	if err != nil {
+		return errors.Wrap(err, "commit: build nydus layer")
+	}
+	defer os.RemoveAll(workDir)
+
+	if err := pushImage(ctx, bootstrap, blob, opts.TargetRef); err != nil {
+		return errors.Wrap(err, "commit: push image")
+	}
+
+	return nil
+}
+
+// overlayChange describes a single changed path observed in an overlay
+// upper dir, following the OverlayFS whiteout conventions.
+type overlayChange struct {
+	path    string // path relative to upperDir
+	deleted bool   // char device 0/0 whiteout
+	opaque  bool   // trusted.overlay.opaque xattr set on a directory
+	isDir   bool
+}
+
+// resolveOverlayUpperDir finds the overlay "upperdir" mount option for the
+// root filesystem of the given pid by reading /proc/<pid>/mountinfo.
+func resolveOverlayUpperDir(pid int) (string, error) {
+	f, err := os.Open(filepath.Join("/proc", strconv.Itoa(pid), "mountinfo"))
+	if err != nil {
+		return "", errors.Wrap(err, "open mountinfo")
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.Contains(line, " - overlay ") {
+			continue
+		}
+		// Field 5 of a mountinfo line is the mount point.
+		if fields := strings.Fields(line); len(fields) < 5 || fields[4] != "/" {
+			continue
+		}
+		for _, opt := range strings.Split(line, ",") {
+			if strings.HasPrefix(opt, "upperdir=") {
+				return strings.TrimPrefix(opt, "upperdir="), nil
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", errors.Wrap(err, "scan mountinfo")
+	}
+	return "", errors.Errorf("no overlay upperdir found for pid %d", pid)
+}
+
+// diffUpperDir walks upperDir and returns the set of changed paths,
+// classifying whiteouts and opaque directories per the OverlayFS convention.
+func diffUpperDir(upperDir string, include, exclude []string) ([]overlayChange, error) {
+	var changes []overlayChange
+	err := filepath.Walk(upperDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == upperDir {
+			return nil
+		}
+		rel, err := filepath.Rel(upperDir, path)
+		if err != nil {
+			return err
+		}
+		if !pathMatches(rel, include, exclude) {
+			if info.IsDir() && !isAncestorOfInclude(rel, include) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		change := overlayChange{path: rel, isDir: info.IsDir()}
+
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			if stat.Mode&syscall.S_IFMT == syscall.S_IFCHR && stat.Rdev == 0 {
+				change.deleted = true
+			}
+		}
+		if info.IsDir() {
+			if opaque, err := isOpaqueDir(path); err != nil {
+				return err
+			} else if opaque {
+				change.opaque = true
+			}
+		}
+
+		changes = append(changes, change)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// isOpaqueDir reports whether path has the trusted.overlay.opaque xattr set,
+// which marks it as fully replacing the corresponding lower directory.
+func isOpaqueDir(path string) (bool, error) {
+	buf := make([]byte, 1)
+	n, err := unix.Getxattr(path, "trusted.overlay.opaque", buf)
+	if err != nil {
+		if errors.Is(err, unix.ENODATA) || errors.Is(err, unix.ENOTSUP) {
+			return false, nil
+		}
+		return false, errors.Wrapf(err, "getxattr %s", path)
+	}
+	return n == 1 && buf[0] == 'y', nil
+}
+
+// pathMatches applies include then exclude filters against a path relative
+// to the upper dir. An empty include list matches everything.
+func pathMatches(rel string, include, exclude []string) bool {
+	if len(include) > 0 && !matchesAny(rel, include) {
+		return false
+	}
+	return !matchesAny(rel, exclude)
+}
+
+// matchesAny reports whether rel equals or is a descendant of one of paths.
+func matchesAny(rel string, paths []string) bool {
+	for _, p := range paths {
+		if rel == p || strings.HasPrefix(rel, p+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAncestorOfInclude reports whether rel must still be descended into even
+// though it doesn't itself match include, because an include path lies
+// underneath it (e.g. rel="var" for include=["var/log"]).
+func isAncestorOfInclude(rel string, include []string) bool {
+	for _, p := range include {
+		if p == rel || strings.HasPrefix(p, rel+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// packChanges writes the collected overlay changes into w as a tar stream,
+// representing deletions as whiteout entries named ".wh.<basename>".
+func packChanges(upperDir string, changes []overlayChange, w *os.File) error {
+	tw := tar.NewWriter(w)
+	defer tw.Close()
+
+	for _, c := range changes {
+		srcPath := filepath.Join(upperDir, c.path)
+
+		name := c.path
+		if c.deleted {
+			dir, base := filepath.Split(c.path)
+			name = filepath.Join(dir, ".wh."+base)
+		}
+
+		var info os.FileInfo
+		var linkTarget string
+		var err error
+		if c.deleted {
+			info = tarFileInfo{c}
+		} else {
+			info, err = os.Lstat(srcPath)
+			if err != nil {
+				return errors.Wrapf(err, "lstat %s", c.path)
+			}
+			if info.Mode()&os.ModeSymlink != 0 {
+				linkTarget, err = os.Readlink(srcPath)
+				if err != nil {
+					return errors.Wrapf(err, "readlink %s", c.path)
+				}
+			}
+		}
+
+		hdr, err := tar.FileInfoHeader(info, linkTarget)
+		if err != nil {
+			return errors.Wrapf(err, "build tar header for %s", c.path)
+		}
+		hdr.Name = name
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return errors.Wrapf(err, "write tar header for %s", c.path)
+		}
+
+		// Per the OCI image-spec, an opaque directory is signalled to layer
+		// consumers (including nydus-image) by a sibling marker file named
+		// ".wh..wh..opq" inside it, not by an overlayfs xattr baked into
+		// the directory's own tar header.
+		if c.opaque {
+			opq := &tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     filepath.Join(name, ".wh..wh..opq"),
+				Mode:     0644,
+			}
+			if err := tw.WriteHeader(opq); err != nil {
+				return errors.Wrapf(err, "write opaque marker for %s", c.path)
+			}
+		}
+
+		if c.deleted || c.isDir {
+			continue
+		}
+
+		if err := copyFileToTar(tw, srcPath); err != nil {
+			return errors.Wrapf(err, "copy %s into tar", c.path)
+		}
+	}
+
+	return nil
+}
+
+// tarFileInfo adapts an overlayChange to os.FileInfo so whiteout entries,
+// which have no backing file to stat, can still go through
+// tar.FileInfoHeader. It is only ever used for c.deleted entries, whose
+// on-disk mode is an overlayfs char-device marker (0/0); per the OCI
+// image-spec a whiteout is a 0-byte regular file named ".wh.<name>", so
+// Mode and IsDir always report plain-regular-file rather than echoing the
+// overlay representation.
+type tarFileInfo struct{ c overlayChange }
+
+func (i tarFileInfo) Name() string       { return filepath.Base(i.c.path) }
+func (i tarFileInfo) Size() int64        { return 0 }
+func (i tarFileInfo) Mode() os.FileMode  { return 0644 }
+func (i tarFileInfo) ModTime() time.Time { return time.Time{} }
+func (i tarFileInfo) IsDir() bool        { return false }
+func (i tarFileInfo) Sys() interface{}   { return nil }
+
+func copyFileToTar(tw *tar.Writer, path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	_, err = io.Copy(tw, src)
+	return err
+}
+
+// cgroupV2Mount is the conventional mount point of the unified cgroup v2
+// hierarchy.
+const cgroupV2Mount = "/sys/fs/cgroup"
+
+// freezerControl names the control file to write and the value that
+// freezes vs. thaws it, which differ between cgroup v1 and v2.
+type freezerControl struct {
+	path   string
+	frozen string
+	thawed string
+}
+
+// freezeContainer pauses the container's cgroup freezer for the duration of
+// the diff and returns a thaw func that must be called to resume it.
+func freezeContainer(pid int) (func(), error) {
+	ctl, err := cgroupFreezerControl(pid)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(ctl.path, []byte(ctl.frozen), 0644); err != nil {
+		return nil, errors.Wrapf(err, "write %q to %s", ctl.frozen, ctl.path)
+	}
+	return func() {
+		_ = os.WriteFile(ctl.path, []byte(ctl.thawed), 0644)
+	}, nil
+}
+
+// cgroupFreezerControl resolves the freezer control file for the cgroup the
+// given pid belongs to, supporting both the cgroup v1 freezer controller
+// (freezer.state, "FROZEN"/"THAWED") and the cgroup v2 unified hierarchy
+// (cgroup.freeze, "1"/"0"). /proc/<pid>/cgroup reports the v1 freezer
+// controller as a line with "freezer" in the controller field, and the v2
+// unified hierarchy as a single "0::<path>" line with an empty controller
+// field; v1 is preferred when both are present, matching how the kernel
+// mounts hybrid hierarchies.
+func cgroupFreezerControl(pid int) (*freezerControl, error) {
+	f, err := os.Open(filepath.Join("/proc", strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return nil, errors.Wrap(err, "open cgroup")
+	}
+	defer f.Close()
+
+	var v2Path string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		hierarchyID, controllers, cgroupPath := fields[0], fields[1], fields[2]
+		if controllers == "freezer" {
+			return &freezerControl{
+				path:   filepath.Join("/sys/fs/cgroup/freezer", cgroupPath, "freezer.state"),
+				frozen: "FROZEN",
+				thawed: "THAWED",
+			}, nil
+		}
+		if hierarchyID == "0" && controllers == "" {
+			v2Path = cgroupPath
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "scan cgroup")
+	}
+	if v2Path != "" {
+		return &freezerControl{
+			path:   filepath.Join(cgroupV2Mount, v2Path, "cgroup.freeze"),
+			frozen: "1",
+			thawed: "0",
+		}, nil
+	}
+	return nil, errors.Errorf("no cgroup freezer found for pid %d", pid)
+}
+
+// buildNydusLayer invokes `nydus-image create` to build a new bootstrap and
+// blob on top of parentBootstrap from the contents of layerTar, returning
+// the paths to the generated bootstrap and blob files plus the temporary
+// work dir containing them, which the caller must remove once done with it.
+func buildNydusLayer(ctx context.Context, parentBootstrap, layerTar string) (bootstrap, blob, workDir string, err error) {
+	workDir, err = os.MkdirTemp("", "nydus-commit-build-*")
+	if err != nil {
+		return "", "", "", errors.Wrap(err, "create build dir")
+	}
+
+	bootstrap = filepath.Join(workDir, "bootstrap")
+	blob = filepath.Join(workDir, "blob")
+
+	cmd := exec.CommandContext(ctx, "nydus-image", "create",
+		"--parent-bootstrap", parentBootstrap,
+		"--bootstrap", bootstrap,
+		"--blob", blob,
+		layerTar,
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		os.RemoveAll(workDir)
+		return "", "", "", errors.Wrapf(err, "nydus-image create: %s", string(out))
+	}
+
+	return bootstrap, blob, workDir, nil
+}
+
+// pushImage pushes the newly built bootstrap and blob to targetRef.
+func pushImage(ctx context.Context, bootstrap, blob, targetRef string) error {
+	cmd := exec.CommandContext(ctx, "nydusify", "push",
+		"--bootstrap", bootstrap,
+		"--blob", blob,
+		"--target", targetRef,
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "nydusify push: %s", string(out))
+	}
+	return nil
+}
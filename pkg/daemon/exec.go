@@ -0,0 +1,149 @@
+//go:build linux
+
+/*
+ * Copyright (c) 2020. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/containerd/nydus-snapshotter/pkg/daemon/nsenter"
+)
+
+// ExecOpts configures a command run inside a container's namespaces via
+// Daemon.RunInContainer.
+type ExecOpts struct {
+	Stdin   io.Reader
+	Env     []string
+	Dir     string
+	Timeout time.Duration
+}
+
+// RunInContainer re-execs the current binary, setting the environment
+// variables that pkg/daemon/nsenter's cgo constructor reads (see that
+// package for why this must be a cgo constructor rather than a Go init()).
+// The re-exec'd process joins pid's mount, pid, uts, net and ipc namespaces
+// before exec'ing argv, and RunInContainer returns the command's stdout and
+// stderr as separate byte slices. This lets the snapshotter observe a container's view of
+// the filesystem, e.g. to validate that a lazy-loaded nydus mount is fully
+// accessible from inside the container, or to collect access traces for
+// prefetch tuning.
+func (d *Daemon) RunInContainer(pid int, argv []string, opts ExecOpts) (stdout, stderr []byte, err error) {
+	if pid <= 0 {
+		return nil, nil, errors.New("RunInContainer: pid is required")
+	}
+	if len(argv) == 0 {
+		return nil, nil, errors.New("RunInContainer: argv is empty")
+	}
+	for _, a := range argv {
+		if strings.Contains(a, nsenter.ArgvSep) {
+			return nil, nil, errors.Errorf("RunInContainer: argv element contains reserved separator: %q", a)
+		}
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "RunInContainer: resolve self executable")
+	}
+
+	ctx := context.Background()
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
+	// Plain exec.Command, not exec.CommandContext: the re-exec'd process
+	// (self) is only the nsenter shim, which forks again inside the
+	// target's namespaces (see pkg/daemon/nsenter) and execs argv in that
+	// grandchild. CommandContext only ever signals cmd.Process, i.e. the
+	// shim, leaving the grandchild as an orphan running inside the
+	// container. Putting the shim in its own process group lets us kill
+	// the whole group - the shim and anything it forked - on cancellation.
+	cmd := exec.Command(self)
+	cmd.Dir = opts.Dir
+	cmd.Stdin = opts.Stdin
+	cmd.Env = append(append(os.Environ(), opts.Env...),
+		nsenter.EnvPid+"="+strconv.Itoa(pid),
+		nsenter.EnvArgv+"="+strings.Join(argv, nsenter.ArgvSep),
+	)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	var outBuf, errBuf bytes.Buffer
+	cmd.Stdout = &outBuf
+	cmd.Stderr = &errBuf
+
+	if err := cmd.Start(); err != nil {
+		return nil, nil, errors.Wrapf(err, "RunInContainer: start %s", strings.Join(argv, " "))
+	}
+
+	waitErr := make(chan error, 1)
+	go func() { waitErr <- cmd.Wait() }()
+
+	var runErr error
+	select {
+	case runErr = <-waitErr:
+	case <-ctx.Done():
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-waitErr
+		runErr = ctx.Err()
+	}
+
+	if runErr != nil {
+		return outBuf.Bytes(), errBuf.Bytes(), errors.Wrapf(runErr, "RunInContainer: %s", strings.Join(argv, " "))
+	}
+
+	return outBuf.Bytes(), errBuf.Bytes(), nil
+}
+
+// ProbeContainerNamespaces reports whether pid's uts/ipc/net/mnt namespaces
+// can be joined, without exec'ing anything inside them. It re-execs the
+// current binary the same way RunInContainer does, but leaves
+// nsenter.EnvArgv unset, which tells the nsenter constructor (see
+// pkg/daemon/nsenter) to exit right after the setns calls instead of
+// forking and exec'ing a target command. This makes it a namespace-only
+// precondition check: unlike RunInContainer, its result never depends on
+// what binaries happen to exist in the target container's rootfs.
+func (d *Daemon) ProbeContainerNamespaces(pid int, timeout time.Duration) error {
+	if pid <= 0 {
+		return errors.New("ProbeContainerNamespaces: pid is required")
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return errors.Wrap(err, "ProbeContainerNamespaces: resolve self executable")
+	}
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, self)
+	cmd.Env = append(os.Environ(), nsenter.EnvPid+"="+strconv.Itoa(pid))
+
+	var errBuf bytes.Buffer
+	cmd.Stderr = &errBuf
+
+	if err := cmd.Run(); err != nil {
+		return errors.Wrapf(err, "ProbeContainerNamespaces: %s", strings.TrimSpace(errBuf.String()))
+	}
+
+	return nil
+}
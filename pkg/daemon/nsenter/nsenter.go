@@ -0,0 +1,39 @@
+//go:build linux
+
+/*
+ * Copyright (c) 2020. Ant Group. All rights reserved.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+// Package nsenter joins a target process's namespaces before the Go runtime
+// starts, mirroring the approach taken by runc/libcontainer's nsenter
+// package. By the time any Go `init()` runs, the runtime has already
+// started extra OS threads (e.g. the sysmon thread), and setns(2) on a
+// mount namespace requires the calling thread to be the process's only
+// thread. A cgo constructor, which runs during C runtime start-up ahead of
+// runtime.rt0_go, is the only point at which that constraint still holds.
+//
+// Configuration is passed entirely through environment variables (see
+// EnvPid and EnvArgv) rather than argv, since the constructor fires before
+// Go has parsed or even has access to os.Args.
+package nsenter
+
+/*
+#cgo CFLAGS: -Wall
+extern void nydus_nsenter_init(void);
+__attribute__((constructor)) static void nydus_nsenter_constructor(void) {
+	nydus_nsenter_init();
+}
+*/
+import "C"
+
+// EnvPid and EnvArgv are the environment variables the nsenter constructor
+// reads to decide whether to act, and what to exec once it has joined the
+// target namespaces. ArgvSep separates argv elements within EnvArgv since
+// an environment variable can only carry a single string.
+const (
+	EnvPid  = "_NYDUS_NSENTER_PID"
+	EnvArgv = "_NYDUS_NSENTER_ARGV"
+	ArgvSep = "\x1f"
+)